@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-martini/martini"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/wandoulabs/codis/pkg/utils"
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+// User is the identity martini makes available to downstream handlers once
+// an Authenticator has approved a request.
+type User struct {
+	Name     string
+	Roles    []string
+	Clusters []string // empty means every cluster is allowed
+}
+
+func (u *User) hasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccess reports whether u is allowed to forward to the given cluster
+// name; an empty Clusters list means unrestricted.
+func (u *User) CanAccess(cluster string) bool {
+	if len(u.Clusters) == 0 {
+		return true
+	}
+	for _, c := range u.Clusters {
+		if c == cluster || c == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+var errAuthFailed = fmt.Errorf("authentication failed")
+
+// bearerEntry is one row of the --auth-bearer-file JSON: token -> identity.
+type bearerEntry struct {
+	User            string   `json:"user"`
+	Roles           []string `json:"roles"`
+	AllowedClusters []string `json:"allowed_clusters"`
+}
+
+// Authenticator checks incoming requests against whichever of basic auth,
+// bearer tokens, or a trusted OIDC-proxy header are configured. If none are
+// configured, it is a no-op and every request is treated as an admin.
+type Authenticator struct {
+	basic      map[string]string // user -> bcrypt hash
+	bearer     map[string]*bearerEntry
+	oidcHeader string
+}
+
+func newAuthenticator() *Authenticator {
+	return &Authenticator{basic: make(map[string]string), bearer: make(map[string]*bearerEntry)}
+}
+
+func (a *Authenticator) enabled() bool {
+	return len(a.basic) != 0 || len(a.bearer) != 0 || a.oidcHeader != ""
+}
+
+func (a *Authenticator) authenticate(req *http.Request) (*User, error) {
+	if user, pass, ok := req.BasicAuth(); ok {
+		hash, ok := a.basic[user]
+		if !ok || bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+			return nil, errAuthFailed
+		}
+		return &User{Name: user, Roles: []string{"admin"}}, nil
+	}
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		e, ok := a.bearer[token]
+		if !ok {
+			return nil, errAuthFailed
+		}
+		return &User{Name: e.User, Roles: e.Roles, Clusters: e.AllowedClusters}, nil
+	}
+	if a.oidcHeader != "" {
+		if name := req.Header.Get(a.oidcHeader); name != "" {
+			return &User{Name: name, Roles: []string{"admin"}}, nil
+		}
+	}
+	return nil, errAuthFailed
+}
+
+// loadAuthenticator builds an Authenticator from the --auth-* flags.
+func loadAuthenticator(d map[string]interface{}) (*Authenticator, error) {
+	authn := newAuthenticator()
+
+	if s, ok := utils.Argument(d, "--auth-basic"); ok {
+		for _, pair := range strings.Split(s, ",") {
+			kv := strings.SplitN(pair, ":", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, errors.Trace(fmt.Errorf("invalid --auth-basic entry %q", pair))
+			}
+			authn.basic[kv[0]] = kv[1]
+		}
+	}
+
+	if s, ok := utils.Argument(d, "--auth-bearer-file"); ok {
+		b, err := ioutil.ReadFile(s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		var tokens map[string]*bearerEntry
+		if err := json.Unmarshal(b, &tokens); err != nil {
+			return nil, errors.Trace(err)
+		}
+		authn.bearer = tokens
+	}
+
+	if s, ok := utils.Argument(d, "--auth-oidc-header"); ok {
+		authn.oidcHeader = s
+	}
+
+	return authn, nil
+}
+
+// authMiddleware gates every route behind authn: unauthenticated or
+// forbidden requests never reach /list or the /** forward route. A readonly
+// user may only pass GET/HEAD requests through.
+//
+// /metrics and /traffic are excluded: they predate auth and are gated by
+// their own standalone --metrics-auth token instead, so that a token alone
+// (with no --auth-* flag configured) is enough to reach them.
+func authMiddleware(authn *Authenticator) martini.Handler {
+	return func(c martini.Context, w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/metrics" || req.URL.Path == "/traffic" {
+			c.Next()
+			return
+		}
+
+		if !authn.enabled() {
+			c.Map(&User{Name: "anonymous", Roles: []string{"admin"}})
+			c.Next()
+			return
+		}
+
+		user, err := authn.authenticate(req)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="codis-fe"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if user.hasRole("readonly") && !user.hasRole("admin") {
+			switch req.Method {
+			case http.MethodGet, http.MethodHead:
+			default:
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		c.Map(user)
+		c.Next()
+	}
+}
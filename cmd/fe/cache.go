@@ -0,0 +1,369 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheRefreshTimeout bounds a background SWR refresh, which runs detached
+// from the inbound request's (by-then-cancelled) context.
+var cacheRefreshTimeout = time.Second * 10
+
+// cacheEntry is one cached response: fresh until staleAt, then served as
+// stale-while-revalidate until expiresAt, after which it is no longer
+// usable at all.
+type cacheEntry struct {
+	status    int
+	header    http.Header
+	body      []byte
+	storedAt  time.Time
+	staleAt   time.Time
+	expiresAt time.Time
+}
+
+func (e *cacheEntry) size() int64               { return int64(len(e.body)) }
+func (e *cacheEntry) fresh(now time.Time) bool  { return now.Before(e.staleAt) }
+func (e *cacheEntry) usable(now time.Time) bool { return now.Before(e.expiresAt) }
+
+type cacheElem struct {
+	key   string
+	entry *cacheEntry
+}
+
+// ResponseCache is an in-memory LRU of proxied GET/HEAD responses, with
+// optional disk spillover for entries evicted to make room under
+// --cache-size. The disk spillover is itself bounded to --cache-size (a
+// second, disk-resident LRU keyed the same way) so it cannot grow without
+// limit, and entries found expired on disk are deleted rather than
+// returned. Concurrent misses for the same key are coalesced with
+// singleflight, and entries past their TTL but within --cache-swr are
+// served immediately while a refresh happens in the background.
+type ResponseCache struct {
+	mu       sync.Mutex
+	ll       *list.List
+	items    map[string]*list.Element
+	curBytes int64
+
+	diskLL       *list.List
+	diskItems    map[string]*list.Element
+	curDiskBytes int64
+
+	maxBytes int64
+	ttl      time.Duration
+	swr      time.Duration
+	diskDir  string
+
+	group singleflight.Group
+}
+
+type diskElem struct {
+	key  string
+	size int64
+}
+
+func newResponseCache() *ResponseCache {
+	return &ResponseCache{
+		ll:        list.New(),
+		items:     make(map[string]*list.Element),
+		diskLL:    list.New(),
+		diskItems: make(map[string]*list.Element),
+	}
+}
+
+func (c *ResponseCache) configure(maxBytes int64, ttl, swr time.Duration, diskDir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes, c.ttl, c.swr, c.diskDir = maxBytes, ttl, swr, diskDir
+	if diskDir != "" {
+		os.MkdirAll(diskDir, 0755)
+	}
+}
+
+func (c *ResponseCache) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.maxBytes > 0 && c.ttl > 0
+}
+
+func cacheKey(forward string, req *http.Request) string {
+	return req.Method + " " + forward + " " + req.URL.Path + "?" + req.URL.RawQuery
+}
+
+func (c *ResponseCache) get(key string) *cacheEntry {
+	c.mu.Lock()
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		entry := el.Value.(*cacheElem).entry
+		c.mu.Unlock()
+		return entry
+	}
+	c.mu.Unlock()
+
+	entry := c.loadDisk(key)
+	if entry == nil {
+		return nil
+	}
+	// Promote the disk hit back into the in-memory LRU so repeated polling
+	// of the same key doesn't keep round-tripping through disk.
+	c.set(key, entry)
+	return entry
+}
+
+func (c *ResponseCache) set(key string, entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.curBytes -= el.Value.(*cacheElem).entry.size()
+		el.Value.(*cacheElem).entry = entry
+		c.ll.MoveToFront(el)
+	} else {
+		el := c.ll.PushFront(&cacheElem{key: key, entry: entry})
+		c.items[key] = el
+	}
+	c.curBytes += entry.size()
+
+	for c.curBytes > c.maxBytes && c.ll.Len() > 0 {
+		back := c.ll.Back()
+		ce := back.Value.(*cacheElem)
+		c.ll.Remove(back)
+		delete(c.items, ce.key)
+		c.curBytes -= ce.entry.size()
+		c.saveDisk(ce.key, ce.entry)
+	}
+}
+
+// flush discards every cached entry, in memory and on disk.
+func (c *ResponseCache) flush() {
+	c.mu.Lock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.curBytes = 0
+	c.diskLL.Init()
+	c.diskItems = make(map[string]*list.Element)
+	c.curDiskBytes = 0
+	dir := c.diskDir
+	c.mu.Unlock()
+
+	if dir != "" {
+		os.RemoveAll(dir)
+		os.MkdirAll(dir, 0755)
+	}
+}
+
+func (c *ResponseCache) diskPath(key string) string {
+	if c.diskDir == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.diskDir, hex.EncodeToString(sum[:]))
+}
+
+// diskEntry is the on-disk JSON representation of a cacheEntry spilled out
+// of the in-memory LRU.
+type diskEntry struct {
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body"`
+	StoredAt  time.Time   `json:"stored_at"`
+	StaleAt   time.Time   `json:"stale_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// saveDisk writes entry to diskDir and registers it in the disk-resident
+// LRU, evicting (and deleting) the oldest spilled entries until the disk
+// cache is back within maxBytes. Called with c.mu already held, from
+// inside set's eviction loop.
+func (c *ResponseCache) saveDisk(key string, entry *cacheEntry) {
+	path := c.diskPath(key)
+	if path == "" {
+		return
+	}
+	b, err := json.Marshal(&diskEntry{
+		Status: entry.status, Header: entry.header, Body: entry.body,
+		StoredAt: entry.storedAt, StaleAt: entry.staleAt, ExpiresAt: entry.expiresAt,
+	})
+	if err != nil {
+		return
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return
+	}
+
+	if el, ok := c.diskItems[key]; ok {
+		c.curDiskBytes -= el.Value.(*diskElem).size
+		c.diskLL.Remove(el)
+	}
+	el := c.diskLL.PushFront(&diskElem{key: key, size: int64(len(b))})
+	c.diskItems[key] = el
+	c.curDiskBytes += int64(len(b))
+
+	for c.curDiskBytes > c.maxBytes && c.diskLL.Len() > 0 {
+		back := c.diskLL.Back()
+		de := back.Value.(*diskElem)
+		c.diskLL.Remove(back)
+		delete(c.diskItems, de.key)
+		c.curDiskBytes -= de.size
+		os.Remove(c.diskPath(de.key))
+	}
+}
+
+// deleteDisk removes key's spilled file, if any, and unregisters it from
+// the disk-resident LRU. Must be called with c.mu held.
+func (c *ResponseCache) deleteDisk(key string) {
+	if el, ok := c.diskItems[key]; ok {
+		c.curDiskBytes -= el.Value.(*diskElem).size
+		c.diskLL.Remove(el)
+		delete(c.diskItems, key)
+	}
+	if path := c.diskPath(key); path != "" {
+		os.Remove(path)
+	}
+}
+
+func (c *ResponseCache) loadDisk(key string) *cacheEntry {
+	path := c.diskPath(key)
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var d diskEntry
+	if json.Unmarshal(b, &d) != nil {
+		return nil
+	}
+	entry := &cacheEntry{
+		status: d.Status, header: d.Header, body: d.Body,
+		storedAt: d.StoredAt, staleAt: d.StaleAt, expiresAt: d.ExpiresAt,
+	}
+	if !entry.usable(time.Now()) {
+		c.mu.Lock()
+		c.deleteDisk(key)
+		c.mu.Unlock()
+		return nil
+	}
+	return entry
+}
+
+// cacheDirectives extracts the response Cache-Control directives this cache
+// understands: no-store/private (never cache) and max-age (overrides the
+// configured --cache-ttl).
+func cacheDirectives(h http.Header) (noStore bool, maxAge time.Duration, hasMaxAge bool) {
+	for _, part := range strings.Split(h.Get("Cache-Control"), ",") {
+		part = strings.TrimSpace(strings.ToLower(part))
+		switch {
+		case part == "no-store" || part == "private":
+			noStore = true
+		case strings.HasPrefix(part, "max-age="):
+			if n, err := strconv.Atoi(strings.TrimPrefix(part, "max-age=")); err == nil {
+				maxAge, hasMaxAge = time.Duration(n)*time.Second, true
+			}
+		}
+	}
+	return
+}
+
+func writeCacheEntry(w http.ResponseWriter, entry *cacheEntry) {
+	header := w.Header()
+	for k, vs := range entry.header {
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+}
+
+// fetch proxies req through route, recording the result and, unless the
+// status is 400 or above or the upstream forbade it via Cache-Control,
+// storing it for the upstream's max-age if given, else the configured TTL.
+func (c *ResponseCache) fetch(key string, route *Route, req *http.Request) *cacheEntry {
+	rec := httptest.NewRecorder()
+	if !route.serveHTTP(rec, req) {
+		return &cacheEntry{status: http.StatusForbidden, header: http.Header{}, storedAt: time.Now()}
+	}
+
+	entry := &cacheEntry{
+		status:   rec.Code,
+		header:   rec.Header().Clone(),
+		body:     rec.Body.Bytes(),
+		storedAt: time.Now(),
+	}
+
+	noStore, maxAge, hasMaxAge := cacheDirectives(rec.Header())
+	if !noStore && rec.Code < http.StatusBadRequest {
+		ttl := c.ttl
+		if hasMaxAge {
+			ttl = maxAge
+		}
+		if ttl > 0 {
+			entry.staleAt = entry.storedAt.Add(ttl)
+			entry.expiresAt = entry.staleAt.Add(c.swr)
+			c.set(key, entry)
+		}
+	}
+	return entry
+}
+
+// refresh re-fetches key in the background; singleflight ensures only one
+// refresh for a given key is ever in flight at a time.
+//
+// It must not reuse the inbound req as-is: net/http cancels req.Context() the
+// moment the handler that spawned this goroutine returns, so by the time the
+// proxy dials out the request would already be dead. Clone just the
+// method/URL/header onto a request carrying its own cache-owned timeout.
+func (c *ResponseCache) refresh(key string, route *Route, req *http.Request) {
+	c.group.Do(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), cacheRefreshTimeout)
+		defer cancel()
+		clone := req.Clone(ctx)
+		clone.Body = http.NoBody
+		clone.ContentLength = 0
+		return c.fetch(key, route, clone), nil
+	})
+}
+
+// serveHTTP answers req from the cache when possible, otherwise proxies it
+// through route (coalescing concurrent misses) and caches the result.
+func (c *ResponseCache) serveHTTP(forward string, route *Route, w http.ResponseWriter, req *http.Request) bool {
+	key := cacheKey(forward, req)
+	now := time.Now()
+
+	if entry := c.get(key); entry != nil && entry.usable(now) {
+		writeCacheEntry(w, entry)
+		if !entry.fresh(now) {
+			go c.refresh(key, route, req)
+		}
+		return true
+	}
+
+	v, _, _ := c.group.Do(key, func() (interface{}, error) {
+		return c.fetch(key, route, req), nil
+	})
+	entry := v.(*cacheEntry)
+	if entry.status == 0 {
+		return false
+	}
+	writeCacheEntry(w, entry)
+	return true
+}
+
+// respCache is the process-wide response cache; it stays disabled (maxBytes
+// 0) until --cache-size is set.
+var respCache = newResponseCache()
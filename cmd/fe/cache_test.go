@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestResponseCacheRefreshSurvivesInboundCancel guards against a background
+// SWR refresh reusing the original inbound request: net/http cancels that
+// request's context as soon as the handler returns, which happens
+// immediately after the refresh goroutine is spawned.
+func TestResponseCacheRefreshSurvivesInboundCancel(t *testing.T) {
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		w.Write([]byte("hit-" + strconv.Itoa(int(n))))
+	}))
+	defer backend.Close()
+
+	route := newRoute("test", []string{strings.TrimPrefix(backend.URL, "http://")})
+	defer route.close()
+
+	c := newResponseCache()
+	c.configure(1<<20, time.Millisecond*20, time.Second, "")
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	req1 := httptest.NewRequest(http.MethodGet, "/topom", nil).WithContext(ctx1)
+	rec1 := httptest.NewRecorder()
+	if !c.serveHTTP("test", route, rec1, req1) {
+		t.Fatalf("first request: expected a response")
+	}
+	if rec1.Body.String() != "hit-1" {
+		t.Fatalf("first request body = %q", rec1.Body.String())
+	}
+	cancel1()
+
+	time.Sleep(time.Millisecond * 30) // entry is now stale but still within the swr window
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	req2 := httptest.NewRequest(http.MethodGet, "/topom", nil).WithContext(ctx2)
+	rec2 := httptest.NewRecorder()
+	if !c.serveHTTP("test", route, rec2, req2) {
+		t.Fatalf("second request: expected a response")
+	}
+	if rec2.Body.String() != "hit-1" {
+		t.Fatalf("stale entry should be served immediately, got %q", rec2.Body.String())
+	}
+	// A real net/http server cancels req2's context the instant ServeHTTP
+	// returns, which is now. The background refresh must not depend on it.
+	cancel2()
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&hits) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if got := atomic.LoadInt32(&hits); got < 2 {
+		t.Fatalf("expected background refresh to reach the backend despite the inbound request's context being cancelled, hits = %d", got)
+	}
+}
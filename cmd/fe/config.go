@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+)
+
+// ConfigLoader watches a dashboard-list JSON file and reloads it whenever its
+// mtime changes. Each entry's "dashboard" field may be either a single
+// "host:port" string or a list of them, the latter being the set of
+// addresses ReverseProxy will health-check and fail over between.
+type ConfigLoader struct {
+	last time.Time
+}
+
+func (l *ConfigLoader) Reload(path string) (map[string][]string, error) {
+	if fi, err := os.Stat(path); err != nil || fi.ModTime().Equal(l.last) {
+		return nil, errors.Trace(err)
+	} else {
+		m, err := l.Load(path)
+		if err != nil {
+			return nil, err
+		}
+		l.last = fi.ModTime()
+		return m, nil
+	}
+}
+
+func (l *ConfigLoader) Load(path string) (map[string][]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var list []*struct {
+		Name      string          `json:"name"`
+		Dashboard json.RawMessage `json:"dashboard"`
+	}
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, errors.Trace(err)
+	}
+	var m = make(map[string][]string)
+	for _, e := range list {
+		addrs, err := parseDashboards(e.Dashboard)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		m[e.Name] = addrs
+	}
+	return m, nil
+}
+
+// parseDashboards accepts either a JSON string or a JSON array of strings,
+// so existing single-dashboard config files keep working unchanged.
+func parseDashboards(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var multi []string
+	if err := json.Unmarshal(raw, &multi); err == nil {
+		return multi, nil
+	}
+	var single string
+	if err := json.Unmarshal(raw, &single); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if single == "" {
+		return nil, nil
+	}
+	return []string{single}, nil
+}
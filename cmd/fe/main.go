@@ -1,36 +1,33 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
-	"sync"
 	"time"
 
 	"github.com/docopt/docopt-go"
 	"github.com/go-martini/martini"
 	"github.com/martini-contrib/render"
 	"github.com/wandoulabs/codis/pkg/utils"
-	"github.com/wandoulabs/codis/pkg/utils/errors"
 	"github.com/wandoulabs/codis/pkg/utils/log"
 	"github.com/wandoulabs/codis/pkg/utils/rpc"
 	"github.com/wandoulabs/codis/pkg/utils/sync2/atomic2"
 )
 
-var roundTripper http.RoundTripper
+// dial is shared by every Route's Transport so dashboard connections are
+// logged and timed out consistently regardless of which cluster they
+// belong to.
+var dial func(network, addr string) (net.Conn, error)
 
 func init() {
 	var dials atomic2.Int64
-	tr := &http.Transport{}
-	tr.Dial = func(network, addr string) (net.Conn, error) {
+	dial = func(network, addr string) (net.Conn, error) {
 		c, err := net.DialTimeout(network, addr, time.Second*10)
 		if err == nil {
 			log.Debugf("rpc: dial new connection to [%d] %s - %s",
@@ -38,27 +35,53 @@ func init() {
 		}
 		return c, err
 	}
-	go func() {
-		for {
-			time.Sleep(time.Minute)
-			tr.CloseIdleConnections()
-		}
-	}()
-	roundTripper = tr
+}
+
+// newTransport builds a Transport for a single Route, so that Route.close
+// can close exactly that route's idle connections instead of relying on a
+// process-wide sweep.
+func newTransport() *http.Transport {
+	return &http.Transport{Dial: dial}
 }
 
 func main() {
 	const usage = `
 Usage:
 	codis-fe [--ncpu=N] --dashboard-list=LIST --listen=ADDR [--log=FILE] [--log-level=LEVEL]
+	         [--health-interval=DURATION] [--health-timeout=DURATION]
+	         [--health-fail=N] [--health-recover=N] [--metrics-auth=TOKEN]
+	         [--tls-cert=FILE --tls-key=FILE | --acme-domain=DOMAIN [--acme-cache-dir=DIR] [--acme-http-addr=ADDR]]
+	         [--redirect-http=ADDR]
+	         [--auth-basic=USERS] [--auth-bearer-file=FILE] [--auth-oidc-header=HEADER]
+	         [--cache-size=MB] [--cache-ttl=DURATION] [--cache-swr=DURATION] [--cache-disk-dir=DIR]
 	codis-fe  --version
 
 Options:
 	--ncpu=N                        set runtime.GOMAXPROCS to N, default is runtime.NumCPU().
-	-d LIST, --dashboard-list=LIST  set list of dashboard, can be generated by codis-admin.
+	-d LIST, --dashboard-list=LIST  set list of dashboard, can be generated by codis-admin. Accepts a bare path or
+	                                file:// for the existing JSON file, or etcd://, zk:// or consul:// to discover
+	                                dashboards from a coordinator instead.
 	-l FILE, --log=FILE             set path/name of daliy rotated log file.
 	--log-level=LEVEL               set the log-level, should be INFO,WARN,DEBUG or ERROR, default is INFO.
 	--listen=ADDR                   set the listen address.
+	--health-interval=DURATION      set the interval between active health-checks of each dashboard, default is 3s.
+	--health-timeout=DURATION       set the timeout of a single health-check request, default is 2s.
+	--health-fail=N                 set the number of consecutive failures before an endpoint is marked down, default is 3.
+	--health-recover=N              set the number of consecutive successes before a down endpoint is marked up again, default is 2.
+	--metrics-auth=TOKEN            require TOKEN (as a Bearer token or ?token=) to reach /metrics and /traffic.
+	--tls-cert=FILE                 serve TLS using this certificate, reloaded on SIGHUP or mtime change.
+	--tls-key=FILE                  private key matching --tls-cert.
+	--acme-domain=DOMAIN            serve TLS using a Let's Encrypt certificate auto-issued for DOMAIN.
+	--acme-cache-dir=DIR            directory to persist ACME account/certificate state in, default is ./acme-cache.
+	--acme-http-addr=ADDR           address for the ACME HTTP-01 challenge listener, default is :80.
+	--redirect-http=ADDR            also listen on ADDR and 301-redirect plain HTTP requests to https://.
+	--auth-basic=USERS              comma-separated user:bcrypt_hash pairs, granted the admin role.
+	--auth-bearer-file=FILE         JSON file of bearer token -> {user,roles,allowed_clusters}.
+	--auth-oidc-header=HEADER       trust HEADER (set by an OIDC-terminating proxy in front of codis-fe) as the user name.
+	--cache-size=MB                 enable the response cache, sized MB megabytes of in-memory entries.
+	--cache-ttl=DURATION             how long a cached GET/HEAD response is served fresh, default is 1s.
+	--cache-swr=DURATION             how much longer a stale response is served while refreshing in the background, default is 5s.
+	--cache-disk-dir=DIR            spill evicted cache entries to DIR instead of dropping them.
 `
 	d, err := docopt.Parse(usage, nil, true, "", false)
 	if err != nil {
@@ -100,28 +123,77 @@ Options:
 	config := utils.ArgumentMust(d, "--dashboard-list")
 	log.Warnf("set config = %s", config)
 
-	loader := &ConfigLoader{}
-	router := &ReverseProxy{}
+	if s, ok := utils.Argument(d, "--health-interval"); ok {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			log.PanicErrorf(err, "option --health-interval = %s", s)
+		}
+		healthCheckInterval = v
+	}
+	if s, ok := utils.Argument(d, "--health-timeout"); ok {
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			log.PanicErrorf(err, "option --health-timeout = %s", s)
+		}
+		healthCheckTimeout = v
+	}
+	if n, ok := utils.ArgumentInteger(d, "--health-fail"); ok {
+		healthFailThreshold = n
+	}
+	if n, ok := utils.ArgumentInteger(d, "--health-recover"); ok {
+		healthRecoverThresh = n
+	}
+	if s, ok := utils.Argument(d, "--metrics-auth"); ok {
+		metricsAuthToken = s
+	}
 
-	go func() {
-		for {
-			m, err := loader.Reload(config)
+	authn, err := loadAuthenticator(d)
+	if err != nil {
+		log.PanicErrorf(err, "load auth config failed")
+	}
+
+	if n, ok := utils.ArgumentInteger(d, "--cache-size"); ok {
+		cacheTTL := time.Second
+		if s, ok := utils.Argument(d, "--cache-ttl"); ok {
+			v, err := time.ParseDuration(s)
 			if err != nil {
-				log.WarnErrorf(err, "reload %s failed", config)
-				time.Sleep(time.Second * 5)
-			} else {
-				if m != nil {
-					log.Infof("reload %s = %v", config, m)
-					router.Update(m)
-				}
-				time.Sleep(time.Second)
+				log.PanicErrorf(err, "option --cache-ttl = %s", s)
 			}
+			cacheTTL = v
+		}
+		cacheSWR := time.Second * 5
+		if s, ok := utils.Argument(d, "--cache-swr"); ok {
+			v, err := time.ParseDuration(s)
+			if err != nil {
+				log.PanicErrorf(err, "option --cache-swr = %s", s)
+			}
+			cacheSWR = v
+		}
+		cacheDiskDir, _ := utils.Argument(d, "--cache-disk-dir")
+		respCache.configure(int64(n)*1024*1024, cacheTTL, cacheSWR, cacheDiskDir)
+	}
+
+	router := &ReverseProxy{}
+
+	src, err := parseDashboardListURI(config)
+	if err != nil {
+		log.PanicErrorf(err, "parse --dashboard-list = %s failed", config)
+	}
+	updates, err := src.Watch(context.Background())
+	if err != nil {
+		log.PanicErrorf(err, "watch --dashboard-list = %s failed", config)
+	}
+	go func() {
+		for m := range updates {
+			log.Infof("reload %s = %v", config, m)
+			router.Update(m)
 		}
 	}()
 
 	m := martini.New()
 	m.Use(martini.Recovery())
 	m.Use(render.Renderer())
+	m.Use(authMiddleware(authn))
 
 	binpath, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
@@ -136,17 +208,49 @@ Options:
 	m.Use(martini.Static(assets, martini.StaticOptions{SkipLogging: true}))
 
 	r := martini.NewRouter()
-	r.Get("/list", func() (int, string) {
-		names := router.Names()
+	// /list keeps returning the flat cluster-name array the bundled UI
+	// (and any other existing consumer) has always expected; the
+	// multi-endpoint health detail introduced alongside failover is opt-in
+	// via ?detail=1, rather than a breaking change to the default shape.
+	r.Get("/list", func(req *http.Request, user *User) (int, string) {
+		status := router.Status()
+		names := make([]string, 0, len(status))
+		for name := range status {
+			if user.CanAccess(name) {
+				names = append(names, name)
+			}
+		}
 		sort.Sort(sort.StringSlice(names))
-		return rpc.ApiResponseJson(names)
+
+		if req.URL.Query().Get("detail") == "" {
+			return rpc.ApiResponseJson(names)
+		}
+
+		clusters := make([]*ClusterStatus, len(names))
+		for i, name := range names {
+			clusters[i] = &ClusterStatus{Name: name, Endpoints: status[name]}
+		}
+		return rpc.ApiResponseJson(clusters)
 	})
 
-	r.Any("/**", func(w http.ResponseWriter, req *http.Request) {
+	r.Get("/metrics", metricsHandler)
+	r.Get("/traffic", trafficHandler)
+
+	r.Post("/admin/cache/flush", func(user *User) (int, string) {
+		if !user.hasRole("admin") {
+			return http.StatusForbidden, "forbidden"
+		}
+		respCache.flush()
+		return http.StatusOK, "ok"
+	})
+
+	r.Any("/**", func(w http.ResponseWriter, req *http.Request, user *User) {
 		name := req.URL.Query().Get("forward")
-		if p := router.GetProxy(name); p != nil {
-			p.ServeHTTP(w, req)
-		} else {
+		if !user.CanAccess(name) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !router.ServeHTTP(name, w, req) {
 			w.WriteHeader(http.StatusForbidden)
 		}
 	})
@@ -160,87 +264,25 @@ Options:
 	}
 	defer l.Close()
 
-	h := http.NewServeMux()
-	h.Handle("/", m)
-	hs := &http.Server{Handler: h}
-	if err := hs.Serve(l); err != nil {
-		log.PanicErrorf(err, "serve %s failed", listen)
-	}
-}
-
-type ConfigLoader struct {
-	last time.Time
-}
-
-func (l *ConfigLoader) Reload(path string) (map[string]string, error) {
-	if fi, err := os.Stat(path); err != nil || fi.ModTime().Equal(l.last) {
-		return nil, errors.Trace(err)
-	} else {
-		m, err := l.Load(path)
-		if err != nil {
-			return nil, err
-		}
-		l.last = fi.ModTime()
-		return m, nil
-	}
-}
+	tlsCert, _ := utils.Argument(d, "--tls-cert")
+	tlsKey, _ := utils.Argument(d, "--tls-key")
+	acmeDomain, _ := utils.Argument(d, "--acme-domain")
+	acmeCacheDir, _ := utils.Argument(d, "--acme-cache-dir")
+	acmeHTTPAddr, _ := utils.Argument(d, "--acme-http-addr")
 
-func (l *ConfigLoader) Load(path string) (map[string]string, error) {
-	b, err := ioutil.ReadFile(path)
+	l, err = wrapTLSListener(l, tlsCert, tlsKey, acmeDomain, acmeCacheDir, acmeHTTPAddr)
 	if err != nil {
-		return nil, errors.Trace(err)
-	}
-	var list []*struct {
-		Name      string `json:"name"`
-		Dashboard string `json:"dashboard"`
-	}
-	if err := json.Unmarshal(b, &list); err != nil {
-		return nil, errors.Trace(err)
-	}
-	var m = make(map[string]string)
-	for _, e := range list {
-		m[e.Name] = e.Dashboard
+		log.PanicErrorf(err, "enable tls on %s failed", listen)
 	}
-	return m, nil
-}
-
-type ReverseProxy struct {
-	sync.Mutex
-	routes map[string]*httputil.ReverseProxy
-}
 
-func (r *ReverseProxy) Update(routes map[string]string) {
-	r.Lock()
-	defer r.Unlock()
-	r.routes = make(map[string]*httputil.ReverseProxy)
-	for name, host := range routes {
-		if name == "" || host == "" {
-			continue
-		}
-		u := &url.URL{Scheme: "http", Host: host}
-		p := httputil.NewSingleHostReverseProxy(u)
-		p.Transport = roundTripper
-		r.routes[name] = p
+	if s, ok := utils.Argument(d, "--redirect-http"); ok {
+		serveRedirectHTTP(s)
 	}
-}
 
-func (r *ReverseProxy) GetProxy(name string) *httputil.ReverseProxy {
-	r.Lock()
-	defer r.Unlock()
-	if r.routes == nil {
-		return nil
-	}
-	return r.routes[name]
-}
-
-func (r *ReverseProxy) Names() []string {
-	r.Lock()
-	defer r.Unlock()
-	var names []string
-	if r.routes != nil {
-		for name, _ := range r.routes {
-			names = append(names, name)
-		}
+	h := http.NewServeMux()
+	h.Handle("/", m)
+	hs := &http.Server{Handler: h}
+	if err := hs.Serve(l); err != nil {
+		log.PanicErrorf(err, "serve %s failed", listen)
 	}
-	return names
 }
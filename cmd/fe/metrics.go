@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"github.com/wandoulabs/codis/pkg/utils/sync2/atomic2"
+)
+
+const latencySampleSize = 256
+
+// ewma is a simple exponentially-weighted moving average, used to smooth the
+// once-a-second rate samples pushed over /traffic so a single slow or empty
+// tick doesn't make the rollup jump around.
+type ewma struct {
+	value float64
+	init  bool
+}
+
+func (e *ewma) update(x float64) float64 {
+	if !e.init {
+		e.value = x
+		e.init = true
+	} else {
+		e.value = 0.5*x + 0.5*e.value
+	}
+	return e.value
+}
+
+// ClusterStats accumulates proxied-traffic counters and latency samples for
+// a single cluster name, fed by an instrumentedTransport wrapping every
+// Endpoint's RoundTripper.
+type ClusterStats struct {
+	name string
+
+	total, ok1xx, ok2xx, ok3xx, ok4xx, ok5xx atomic2.Int64
+	bytesIn, bytesOut                        atomic2.Int64
+
+	mu      sync.Mutex
+	samples [latencySampleSize]time.Duration
+	pos     int64
+
+	last struct {
+		at                  time.Time
+		total, err, in, out int64
+	}
+	rpsEWMA, errEWMA, inEWMA, outEWMA ewma
+}
+
+func newClusterStats(name string) *ClusterStats {
+	s := &ClusterStats{name: name}
+	s.last.at = time.Now()
+	return s
+}
+
+// observe records one completed round trip's status and latency. Byte
+// counts are tracked separately, as the request/response bodies are
+// streamed rather than fully read by the time a status is known (see
+// instrumentedTransport.RoundTrip).
+func (s *ClusterStats) observe(status int, latency time.Duration, err error) {
+	s.total.Incr()
+	switch {
+	case err != nil || status/100 == 5:
+		s.ok5xx.Incr()
+	case status/100 == 4:
+		s.ok4xx.Incr()
+	case status/100 == 3:
+		s.ok3xx.Incr()
+	case status/100 == 2:
+		s.ok2xx.Incr()
+	case status/100 == 1:
+		s.ok1xx.Incr()
+	}
+
+	s.mu.Lock()
+	s.samples[s.pos%latencySampleSize] = latency
+	s.pos++
+	s.mu.Unlock()
+}
+
+func (s *ClusterStats) quantiles() (p50, p99 time.Duration) {
+	s.mu.Lock()
+	n := int(s.pos)
+	if n > latencySampleSize {
+		n = latencySampleSize
+	}
+	buf := make([]time.Duration, n)
+	copy(buf, s.samples[:n])
+	s.mu.Unlock()
+
+	if n == 0 {
+		return 0, 0
+	}
+	sort.Slice(buf, func(i, j int) bool { return buf[i] < buf[j] })
+	p50 = buf[n*50/100]
+	idx99 := n * 99 / 100
+	if idx99 >= n {
+		idx99 = n - 1
+	}
+	return p50, buf[idx99]
+}
+
+// tick samples the counters once a second, turning cumulative totals into
+// an EWMA-smoothed TrafficFrame.
+func (s *ClusterStats) tick(now time.Time) TrafficFrame {
+	total := s.total.Int64()
+	err := s.ok5xx.Int64()
+	in := s.bytesIn.Int64()
+	out := s.bytesOut.Int64()
+
+	dt := now.Sub(s.last.at).Seconds()
+	if dt <= 0 {
+		dt = 1
+	}
+	rps := s.rpsEWMA.update(float64(total-s.last.total) / dt)
+	errRps := s.errEWMA.update(float64(err-s.last.err) / dt)
+	inBps := s.inEWMA.update(float64(in-s.last.in) / dt)
+	outBps := s.outEWMA.update(float64(out-s.last.out) / dt)
+
+	s.last.at, s.last.total, s.last.err, s.last.in, s.last.out = now, total, err, in, out
+
+	p50, p99 := s.quantiles()
+	return TrafficFrame{
+		Cluster: s.name,
+		RPS:     rps,
+		ErrRPS:  errRps,
+		P50Ms:   p50.Seconds() * 1000,
+		P99Ms:   p99.Seconds() * 1000,
+		InBps:   inBps,
+		OutBps:  outBps,
+	}
+}
+
+// TrafficFrame is one cluster's rollup pushed once a second over /traffic.
+type TrafficFrame struct {
+	Cluster string  `json:"cluster"`
+	RPS     float64 `json:"rps"`
+	ErrRPS  float64 `json:"err_rps"`
+	P50Ms   float64 `json:"p50_ms"`
+	P99Ms   float64 `json:"p99_ms"`
+	InBps   float64 `json:"in_bps"`
+	OutBps  float64 `json:"out_bps"`
+}
+
+// MetricsRegistry owns per-cluster ClusterStats plus the set of /traffic
+// subscribers that get a []TrafficFrame pushed to them once a second.
+type MetricsRegistry struct {
+	mu       sync.Mutex
+	clusters map[string]*ClusterStats
+	subs     map[chan []TrafficFrame]struct{}
+}
+
+func newMetricsRegistry() *MetricsRegistry {
+	m := &MetricsRegistry{
+		clusters: make(map[string]*ClusterStats),
+		subs:     make(map[chan []TrafficFrame]struct{}),
+	}
+	go m.rollupLoop()
+	return m
+}
+
+func (m *MetricsRegistry) statsFor(name string) *ClusterStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.clusters[name]
+	if !ok {
+		s = newClusterStats(name)
+		m.clusters[name] = s
+	}
+	return s
+}
+
+// transportFor wraps next with an instrumenting RoundTripper that records
+// into the ClusterStats for name.
+func (m *MetricsRegistry) transportFor(name string, next http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{next: next, stats: m.statsFor(name)}
+}
+
+func (m *MetricsRegistry) subscribe() chan []TrafficFrame {
+	ch := make(chan []TrafficFrame, 4)
+	m.mu.Lock()
+	m.subs[ch] = struct{}{}
+	m.mu.Unlock()
+	return ch
+}
+
+func (m *MetricsRegistry) unsubscribe(ch chan []TrafficFrame) {
+	m.mu.Lock()
+	delete(m.subs, ch)
+	m.mu.Unlock()
+}
+
+func (m *MetricsRegistry) rollupLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		m.mu.Lock()
+		stats := make([]*ClusterStats, 0, len(m.clusters))
+		for _, s := range m.clusters {
+			stats = append(stats, s)
+		}
+		subs := make([]chan []TrafficFrame, 0, len(m.subs))
+		for ch := range m.subs {
+			subs = append(subs, ch)
+		}
+		m.mu.Unlock()
+
+		if len(subs) == 0 || len(stats) == 0 {
+			continue
+		}
+		frames := make([]TrafficFrame, len(stats))
+		for i, s := range stats {
+			frames[i] = s.tick(now)
+		}
+		for _, ch := range subs {
+			select {
+			case ch <- frames:
+			default:
+			}
+		}
+	}
+}
+
+// WritePrometheus renders every cluster's counters in the Prometheus text
+// exposition format.
+func (m *MetricsRegistry) WritePrometheus(w io.Writer) {
+	m.mu.Lock()
+	stats := make([]*ClusterStats, 0, len(m.clusters))
+	for _, s := range m.clusters {
+		stats = append(stats, s)
+	}
+	m.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].name < stats[j].name })
+
+	fmt.Fprintln(w, "# HELP codisfe_requests_total Total proxied requests per cluster.")
+	fmt.Fprintln(w, "# TYPE codisfe_requests_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "codisfe_requests_total{cluster=%q,code=\"1xx\"} %d\n", s.name, s.ok1xx.Int64())
+		fmt.Fprintf(w, "codisfe_requests_total{cluster=%q,code=\"2xx\"} %d\n", s.name, s.ok2xx.Int64())
+		fmt.Fprintf(w, "codisfe_requests_total{cluster=%q,code=\"3xx\"} %d\n", s.name, s.ok3xx.Int64())
+		fmt.Fprintf(w, "codisfe_requests_total{cluster=%q,code=\"4xx\"} %d\n", s.name, s.ok4xx.Int64())
+		fmt.Fprintf(w, "codisfe_requests_total{cluster=%q,code=\"5xx\"} %d\n", s.name, s.ok5xx.Int64())
+	}
+
+	fmt.Fprintln(w, "# HELP codisfe_bytes_total Bytes proxied per cluster.")
+	fmt.Fprintln(w, "# TYPE codisfe_bytes_total counter")
+	for _, s := range stats {
+		fmt.Fprintf(w, "codisfe_bytes_total{cluster=%q,direction=\"in\"} %d\n", s.name, s.bytesIn.Int64())
+		fmt.Fprintf(w, "codisfe_bytes_total{cluster=%q,direction=\"out\"} %d\n", s.name, s.bytesOut.Int64())
+	}
+
+	fmt.Fprintln(w, "# HELP codisfe_request_latency_ms Proxied request latency in milliseconds.")
+	fmt.Fprintln(w, "# TYPE codisfe_request_latency_ms summary")
+	for _, s := range stats {
+		p50, p99 := s.quantiles()
+		fmt.Fprintf(w, "codisfe_request_latency_ms{cluster=%q,quantile=\"0.5\"} %f\n", s.name, p50.Seconds()*1000)
+		fmt.Fprintf(w, "codisfe_request_latency_ms{cluster=%q,quantile=\"0.99\"} %f\n", s.name, p99.Seconds()*1000)
+	}
+}
+
+// instrumentedTransport wraps an http.RoundTripper, recording per-cluster
+// counters and latency for every round trip it performs.
+type instrumentedTransport struct {
+	next  http.RoundTripper
+	stats *ClusterStats
+}
+
+// countingReadCloser wraps an io.ReadCloser, adding every byte actually
+// read through it to counter. Content-Length is unreliable for the bodies
+// this transport sees (-1 for chunked/streamed dashboard responses, -1/0
+// for GET requests), so bytesIn/bytesOut are tallied as the bodies are
+// streamed rather than trusted from the header.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter *atomic2.Int64
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		c.counter.Add(int64(n))
+	}
+	return n, err
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body = &countingReadCloser{ReadCloser: req.Body, counter: &t.stats.bytesIn}
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+	if err != nil {
+		t.stats.observe(0, latency, err)
+		return resp, err
+	}
+	if resp.Body != nil {
+		resp.Body = &countingReadCloser{ReadCloser: resp.Body, counter: &t.stats.bytesOut}
+	}
+	t.stats.observe(resp.StatusCode, latency, nil)
+	return resp, nil
+}
+
+// metrics is the process-wide registry; every Route wraps its endpoints'
+// transports with it so /metrics and /traffic stay in sync with what
+// ReverseProxy is actually serving.
+var metrics = newMetricsRegistry()
+
+// metricsAuthToken, when non-empty, is required (as a Bearer token or
+// ?token= query parameter) to reach /metrics or /traffic.
+var metricsAuthToken string
+
+func requireMetricsAuth(req *http.Request) bool {
+	if metricsAuthToken == "" {
+		return true
+	}
+	if tok := req.URL.Query().Get("token"); tok == metricsAuthToken {
+		return true
+	}
+	if auth := req.Header.Get("Authorization"); auth == "Bearer "+metricsAuthToken {
+		return true
+	}
+	return false
+}
+
+func metricsHandler(w http.ResponseWriter, req *http.Request) {
+	if !requireMetricsAuth(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	metrics.WritePrometheus(w)
+}
+
+func trafficHandler(w http.ResponseWriter, req *http.Request) {
+	if !requireMetricsAuth(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	websocket.Handler(func(ws *websocket.Conn) {
+		ch := metrics.subscribe()
+		defer metrics.unsubscribe(ch)
+		for frames := range ch {
+			if err := websocket.JSON.Send(ws, frames); err != nil {
+				return
+			}
+		}
+	}).ServeHTTP(w, req)
+}
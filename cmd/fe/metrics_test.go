@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestClusterStatsObserveAndWritePrometheus round-trips observe() through
+// WritePrometheus, guarding against the counters (atomic2.Int64), the
+// status/100 bucketing, and the renderer drifting apart.
+func TestClusterStatsObserveAndWritePrometheus(t *testing.T) {
+	s := newClusterStats("test")
+	s.observe(http.StatusOK, time.Millisecond, nil)
+	s.observe(http.StatusFound, time.Millisecond, nil) // 302: must land in 3xx, not 2xx
+	s.observe(http.StatusNotFound, time.Millisecond, nil)
+	s.observe(0, time.Millisecond, errors.New("dial failed"))
+	s.bytesIn.Add(30)
+	s.bytesOut.Add(40)
+
+	m := newMetricsRegistry()
+	m.clusters["test"] = s
+
+	var buf bytes.Buffer
+	m.WritePrometheus(&buf)
+	out := buf.String()
+
+	for _, want := range []string{
+		`codisfe_requests_total{cluster="test",code="2xx"} 1`,
+		`codisfe_requests_total{cluster="test",code="3xx"} 1`,
+		`codisfe_requests_total{cluster="test",code="4xx"} 1`,
+		`codisfe_requests_total{cluster="test",code="5xx"} 1`,
+		`codisfe_bytes_total{cluster="test",direction="in"} 30`,
+		`codisfe_bytes_total{cluster="test",direction="out"} 40`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("WritePrometheus output missing %q, got:\n%s", want, out)
+		}
+	}
+}
+
+// TestClusterStatsTick checks that tick() reports a nonzero rate once
+// observe() has recorded requests, and that it doesn't panic or divide by
+// zero on the very first call.
+func TestClusterStatsTick(t *testing.T) {
+	s := newClusterStats("test")
+	for i := 0; i < 5; i++ {
+		s.observe(http.StatusOK, time.Millisecond, nil)
+	}
+
+	frame := s.tick(s.last.at.Add(time.Second))
+	if frame.Cluster != "test" {
+		t.Fatalf("frame.Cluster = %q, want %q", frame.Cluster, "test")
+	}
+	if frame.RPS <= 0 {
+		t.Fatalf("frame.RPS = %v, want > 0 after 5 observed requests", frame.RPS)
+	}
+}
+
+// TestInstrumentedTransportObservesRoundTrip checks that a RoundTripper
+// wrapped by instrumentedTransport feeds its ClusterStats on every call,
+// including failed round trips.
+func TestInstrumentedTransportObservesRoundTrip(t *testing.T) {
+	s := newClusterStats("test")
+	tr := &instrumentedTransport{next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("boom")
+	}), stats: s}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com", nil)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatalf("expected the wrapped transport's error to propagate")
+	}
+	if got := s.ok5xx.Int64(); got != 1 {
+		t.Fatalf("ok5xx = %d, want 1 after a failed round trip", got)
+	}
+}
+
+// TestInstrumentedTransportCountsStreamedBytes guards against trusting
+// Content-Length for byte counting: it is -1 for chunked/streamed bodies
+// (exactly what the dashboard's streamed endpoints return), so bytes must
+// be tallied as the request/response bodies are actually read.
+func TestInstrumentedTransportCountsStreamedBytes(t *testing.T) {
+	s := newClusterStats("test")
+	tr := &instrumentedTransport{next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		ioutil.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			ContentLength: -1, // as for a chunked/streamed upstream response
+			Body:          ioutil.NopCloser(strings.NewReader("hello world")),
+		}, nil
+	}), stats: s}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://example.com", strings.NewReader("payload"))
+	req.ContentLength = -1 // as for a chunked request body
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	ioutil.ReadAll(resp.Body) // the proxy streams this to the client after RoundTrip returns
+
+	if got := s.bytesIn.Int64(); got != int64(len("payload")) {
+		t.Fatalf("bytesIn = %d, want %d", got, len("payload"))
+	}
+	if got := s.bytesOut.Int64(); got != int64(len("hello world")) {
+		t.Fatalf("bytesOut = %d, want %d", got, len("hello world"))
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
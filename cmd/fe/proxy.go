@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+var (
+	healthCheckPath     = "/topom"
+	healthCheckInterval = time.Second * 3
+	healthCheckTimeout  = time.Second * 2
+	healthFailThreshold = 3
+	healthRecoverThresh = 2
+)
+
+// EndpointStatus is the JSON view of an Endpoint's current health, as
+// surfaced by /list.
+type EndpointStatus struct {
+	Addr      string    `json:"addr"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+	LastCheck time.Time `json:"last_check"`
+}
+
+// ClusterStatus is the JSON view of /list?detail=1: a cluster name together with the
+// health of every dashboard endpoint registered for it, ordered with the
+// currently-primary (first healthy) endpoint first.
+type ClusterStatus struct {
+	Name      string           `json:"name"`
+	Endpoints []EndpointStatus `json:"endpoints"`
+}
+
+// Endpoint is a single dashboard address being health-checked by a Route.
+type Endpoint struct {
+	Addr string
+
+	mu        sync.RWMutex
+	healthy   bool
+	fails     int
+	oks       int
+	lastErr   string
+	lastCheck time.Time
+}
+
+func newEndpoint(addr string) *Endpoint {
+	return &Endpoint{Addr: addr, healthy: true}
+}
+
+func (e *Endpoint) IsHealthy() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.healthy
+}
+
+func (e *Endpoint) Status() EndpointStatus {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return EndpointStatus{
+		Addr:      e.Addr,
+		Healthy:   e.healthy,
+		LastError: e.lastErr,
+		LastCheck: e.lastCheck,
+	}
+}
+
+func (e *Endpoint) markResult(err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.lastCheck = time.Now()
+	if err != nil {
+		e.fails++
+		e.oks = 0
+		e.lastErr = err.Error()
+		if e.fails >= healthFailThreshold {
+			e.healthy = false
+		}
+		return
+	}
+	e.fails = 0
+	e.oks++
+	e.lastErr = ""
+	if !e.healthy && e.oks >= healthRecoverThresh {
+		e.healthy = true
+	}
+}
+
+func (e *Endpoint) healthCheckLoop(stop <-chan struct{}) {
+	client := &http.Client{Timeout: healthCheckTimeout}
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			e.check(client)
+		}
+	}
+}
+
+func (e *Endpoint) check(client *http.Client) {
+	u := url.URL{Scheme: "http", Host: e.Addr, Path: healthCheckPath}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		e.markResult(err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		e.markResult(fmt.Errorf("status = %d", resp.StatusCode))
+		return
+	}
+	e.markResult(nil)
+}
+
+// Route is the set of dashboard endpoints registered for a single cluster
+// name. Requests are sent to the first healthy endpoint; if it answers with
+// a 5xx or fails to dial, the request transparently falls over to the next
+// healthy endpoint.
+type Route struct {
+	name string
+
+	mu        sync.RWMutex
+	endpoints []*Endpoint
+	proxies   map[string]*httputil.ReverseProxy
+
+	transport *http.Transport
+	stop      chan struct{}
+}
+
+func newRoute(name string, addrs []string) *Route {
+	tr := newTransport()
+	r := &Route{
+		name:      name,
+		proxies:   make(map[string]*httputil.ReverseProxy),
+		transport: tr,
+		stop:      make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		ep := newEndpoint(addr)
+		r.endpoints = append(r.endpoints, ep)
+		u := &url.URL{Scheme: "http", Host: addr}
+		p := httputil.NewSingleHostReverseProxy(u)
+		p.Transport = metrics.transportFor(name, tr)
+		p.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			if pw, ok := w.(*peekedWriter); ok {
+				pw.dialErr = err
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		r.proxies[addr] = p
+		go ep.healthCheckLoop(r.stop)
+	}
+	return r
+}
+
+// close stops every endpoint's health-check loop and closes r's idle
+// connections, so a Route dropped by ReverseProxy.Update doesn't leave
+// dashboard connections open until the process exits.
+func (r *Route) close() {
+	close(r.stop)
+	r.transport.CloseIdleConnections()
+}
+
+func (r *Route) orderedEndpoints() []*Endpoint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var healthy, rest []*Endpoint
+	for _, ep := range r.endpoints {
+		if ep.IsHealthy() {
+			healthy = append(healthy, ep)
+		} else {
+			rest = append(rest, ep)
+		}
+	}
+	return append(healthy, rest...)
+}
+
+// sameAddrs reports whether r already proxies exactly this set of
+// addresses, regardless of order.
+func (r *Route) sameAddrs(addrs []string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(addrs) != len(r.endpoints) {
+		return false
+	}
+	want := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		want[addr] = struct{}{}
+	}
+	for _, ep := range r.endpoints {
+		if _, ok := want[ep.Addr]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Route) Status() []EndpointStatus {
+	eps := r.orderedEndpoints()
+	list := make([]EndpointStatus, len(eps))
+	for i, ep := range eps {
+		list[i] = ep.Status()
+	}
+	return list
+}
+
+// serveHTTP proxies req to the first healthy endpoint, retrying against the
+// remaining endpoints (in health order) on a dial error or 5xx response. Only
+// the status line and headers are peeked before committing to an endpoint;
+// the body streams straight to w instead of being buffered in full, so
+// chunked/streaming dashboard responses aren't broken or doubled in memory.
+func (r *Route) serveHTTP(w http.ResponseWriter, req *http.Request) bool {
+	order := r.orderedEndpoints()
+	if len(order) == 0 {
+		return false
+	}
+
+	var body []byte
+	if req.Body != nil {
+		body, _ = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+	}
+
+	r.mu.RLock()
+	proxies := r.proxies
+	r.mu.RUnlock()
+
+	for i, ep := range order {
+		proxy, ok := proxies[ep.Addr]
+		if !ok {
+			continue
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+
+		pw := &peekedWriter{real: w, header: make(http.Header), last: i == len(order)-1}
+		proxy.ServeHTTP(pw, req)
+
+		// Only a transport-level failure (dial/connect/timeout) feeds the
+		// endpoint's health state here: it means the endpoint itself is
+		// unreachable, same as a failed active health check. An ordinary
+		// 5xx *response* from a reachable dashboard is an application
+		// error, not a liveness signal — it still triggers failover for
+		// this request, but healthy/fails/oks are left for the dedicated
+		// /topom health-check loop to manage.
+		if pw.dialErr != nil {
+			ep.markResult(pw.dialErr)
+		}
+		if pw.forwarded {
+			return true
+		}
+		if pw.dialErr != nil {
+			log.Warnf("fe: endpoint %s for %s unreachable (%v), failing over", ep.Addr, r.name, pw.dialErr)
+		} else {
+			log.Warnf("fe: endpoint %s for %s returned %d, failing over", ep.Addr, r.name, pw.code)
+		}
+	}
+	return false
+}
+
+// peekedWriter sits between a Route and the real ResponseWriter during a
+// single endpoint attempt. It holds the response open just long enough to
+// see the status code: once committed (a non-5xx status, or the last
+// endpoint in the failover chain), headers and all further body writes flow
+// straight through to the real writer. If an earlier endpoint reports a 5xx
+// and a retry is still possible, the body is discarded so the next endpoint
+// can be tried against an untouched ResponseWriter.
+type peekedWriter struct {
+	real   http.ResponseWriter
+	header http.Header
+	last   bool
+
+	code      int
+	written   bool
+	forwarded bool
+	dialErr   error // set by Route's ReverseProxy.ErrorHandler on a transport-level failure
+}
+
+func (pw *peekedWriter) Header() http.Header { return pw.header }
+
+func (pw *peekedWriter) WriteHeader(code int) {
+	if pw.written {
+		return
+	}
+	pw.written = true
+	pw.code = code
+	pw.forwarded = code < http.StatusInternalServerError || pw.last
+	if pw.forwarded {
+		dst := pw.real.Header()
+		for k, vs := range pw.header {
+			dst[k] = vs
+		}
+		pw.real.WriteHeader(code)
+	}
+}
+
+func (pw *peekedWriter) Write(b []byte) (int, error) {
+	if !pw.written {
+		pw.WriteHeader(http.StatusOK)
+	}
+	if !pw.forwarded {
+		return len(b), nil
+	}
+	return pw.real.Write(b)
+}
+
+func (pw *peekedWriter) Flush() {
+	if !pw.forwarded {
+		return
+	}
+	if f, ok := pw.real.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ReverseProxy maps cluster names to their Route of dashboard endpoints. It
+// is fed a full config snapshot on every discovery update, but only the
+// clusters whose endpoint set actually changed are rebuilt: a config source
+// (etcd/ZooKeeper/Consul watches in particular) can re-emit the same
+// topology on unrelated key churn, and rebuilding every Route on every
+// emission would reset in-flight health/failover state for no reason.
+type ReverseProxy struct {
+	sync.Mutex
+	routes map[string]*Route
+}
+
+func (rp *ReverseProxy) Update(config map[string][]string) {
+	rp.Lock()
+	defer rp.Unlock()
+	next := make(map[string]*Route, len(config))
+	for name, addrs := range config {
+		if name == "" || len(addrs) == 0 {
+			continue
+		}
+		if route, ok := rp.routes[name]; ok && route.sameAddrs(addrs) {
+			next[name] = route
+			continue
+		}
+		next[name] = newRoute(name, addrs)
+	}
+	prev := rp.routes
+	rp.routes = next
+	for name, route := range prev {
+		if next[name] != route {
+			route.close()
+		}
+	}
+}
+
+func (rp *ReverseProxy) route(name string) *Route {
+	rp.Lock()
+	defer rp.Unlock()
+	if rp.routes == nil {
+		return nil
+	}
+	return rp.routes[name]
+}
+
+func (rp *ReverseProxy) ServeHTTP(name string, w http.ResponseWriter, req *http.Request) bool {
+	route := rp.route(name)
+	if route == nil {
+		return false
+	}
+	if respCache.enabled() && isSafeMethod(req.Method) {
+		return respCache.serveHTTP(name, route, w, req)
+	}
+	return route.serveHTTP(w, req)
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead
+}
+
+func (rp *ReverseProxy) Names() []string {
+	rp.Lock()
+	defer rp.Unlock()
+	var names []string
+	for name := range rp.routes {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (rp *ReverseProxy) Status() map[string][]EndpointStatus {
+	rp.Lock()
+	routes := make([]*Route, 0, len(rp.routes))
+	for _, route := range rp.routes {
+		routes = append(routes, route)
+	}
+	rp.Unlock()
+
+	status := make(map[string][]EndpointStatus, len(routes))
+	for _, route := range routes {
+		status[route.name] = route.Status()
+	}
+	return status
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func addrOf(s *httptest.Server) string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// TestReverseProxyUpdatePreservesUnchangedRoutes checks that re-emitting the
+// same address set for a cluster (as a coordinator-backed Source can do on
+// unrelated key churn) keeps the existing Route, rather than resetting its
+// health/failover state.
+func TestReverseProxyUpdatePreservesUnchangedRoutes(t *testing.T) {
+	rp := &ReverseProxy{}
+	rp.Update(map[string][]string{"a": {"10.0.0.1:1234", "10.0.0.2:1234"}})
+	before := rp.route("a")
+	if before == nil {
+		t.Fatalf("expected route \"a\" to exist")
+	}
+
+	rp.Update(map[string][]string{"a": {"10.0.0.2:1234", "10.0.0.1:1234"}})
+	after := rp.route("a")
+	if before != after {
+		t.Fatalf("expected unchanged address set (reordered) to preserve the existing Route")
+	}
+
+	rp.Update(map[string][]string{"a": {"10.0.0.1:1234"}})
+	changed := rp.route("a")
+	if changed == before {
+		t.Fatalf("expected a changed address set to rebuild the Route")
+	}
+	changed.close()
+}
+
+// TestRouteServeHTTPFailsOverOn5xx checks that a 5xx from the first endpoint
+// falls over to the next healthy one, and that repeated application-level
+// 5xx responses from a reachable endpoint do NOT flip its health: liveness
+// is the dedicated /topom health-check loop's job, not the request path's
+// (see proxy.go's serveHTTP).
+func TestRouteServeHTTPFailsOverOn5xx(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer bad.Close()
+
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	}))
+	defer good.Close()
+
+	route := newRoute("test", []string{addrOf(bad), addrOf(good)})
+	defer route.close()
+
+	req := httptest.NewRequest(http.MethodGet, "/topom", nil)
+	rec := httptest.NewRecorder()
+	if !route.serveHTTP(rec, req) {
+		t.Fatalf("expected serveHTTP to succeed via failover")
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Fatalf("got status %d body %q, want 200 \"ok\"", rec.Code, rec.Body.String())
+	}
+
+	badEP := route.endpoints[0]
+	for i := 0; i < healthFailThreshold; i++ {
+		rec := httptest.NewRecorder()
+		route.serveHTTP(rec, httptest.NewRequest(http.MethodGet, "/topom", nil))
+	}
+	if !badEP.IsHealthy() {
+		t.Fatalf("endpoint %s should stay healthy after ordinary 5xx responses; only the active health check should flip it", badEP.Addr)
+	}
+}
+
+// TestRouteServeHTTPDialErrorMarksEndpointUnhealthy checks that, unlike an
+// ordinary 5xx response, a transport-level failure (the endpoint is simply
+// unreachable) does flip the endpoint's health from the request path — the
+// same signal the active health-check loop would eventually observe.
+func TestRouteServeHTTPDialErrorMarksEndpointUnhealthy(t *testing.T) {
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	addr := addrOf(unreachable)
+	unreachable.Close() // nothing is listening at addr from here on
+
+	route := newRoute("test", []string{addr})
+	defer route.close()
+
+	for i := 0; i < healthFailThreshold; i++ {
+		rec := httptest.NewRecorder()
+		route.serveHTTP(rec, httptest.NewRequest(http.MethodGet, "/topom", nil))
+	}
+	ep := route.endpoints[0]
+	if ep.IsHealthy() {
+		t.Fatalf("endpoint %s should be unhealthy after %d consecutive dial errors", ep.Addr, healthFailThreshold)
+	}
+}
+
+// TestRouteServeHTTPStreamsBody ensures a committed response is copied to
+// the real ResponseWriter verbatim, rather than dropped or truncated by the
+// peek-then-forward plumbing that replaced full buffering.
+func TestRouteServeHTTPStreamsBody(t *testing.T) {
+	const want = "line-one\nline-two\nline-three\n"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "yes")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(want))
+	}))
+	defer backend.Close()
+
+	route := newRoute("test", []string{addrOf(backend)})
+	defer route.close()
+
+	rec := httptest.NewRecorder()
+	if !route.serveHTTP(rec, httptest.NewRequest(http.MethodGet, "/topom", nil)) {
+		t.Fatalf("expected serveHTTP to succeed")
+	}
+	if rec.Body.String() != want {
+		t.Fatalf("body = %q, want %q", rec.Body.String(), want)
+	}
+	if rec.Header().Get("X-Test") != "yes" {
+		t.Fatalf("expected X-Test header to be forwarded")
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// Source watches wherever a --dashboard-list points (a JSON file, or an
+// etcd/ZooKeeper/Consul coordinator) and emits the current cluster name ->
+// dashboard-address-list mapping every time it changes. The channel is
+// closed when ctx is done.
+type Source interface {
+	Watch(ctx context.Context) (<-chan map[string][]string, error)
+}
+
+// parseDashboardListURI dispatches a --dashboard-list value to the Source
+// implementation for its scheme: file:///path.json, etcd://host:2379/codis3,
+// zk://zk1,zk2/codis3, consul://host:8500/codis. A bare path with no scheme
+// is treated as a file, so existing configs keep working unchanged.
+func parseDashboardListURI(raw string) (Source, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	switch u.Scheme {
+	case "", "file":
+		path := raw
+		if u.Scheme == "file" {
+			path = u.Path
+		}
+		return newFileSource(path), nil
+	case "etcd":
+		return newEtcdSource(u)
+	case "zk":
+		return newZkSource(u)
+	case "consul":
+		return newConsulSource(u)
+	default:
+		return nil, errors.Trace(fmt.Errorf("unsupported dashboard-list scheme %q", u.Scheme))
+	}
+}
+
+// FileSource is the original behavior: poll a JSON file for mtime changes.
+type FileSource struct {
+	path string
+}
+
+func newFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (s *FileSource) Watch(ctx context.Context) (<-chan map[string][]string, error) {
+	ch := make(chan map[string][]string, 1)
+	go func() {
+		defer close(ch)
+		loader := &ConfigLoader{}
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m, err := loader.Reload(s.path)
+				if err != nil {
+					log.WarnErrorf(err, "reload %s failed", s.path)
+					continue
+				}
+				if m == nil {
+					continue
+				}
+				select {
+				case ch <- m:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// topomMeta is the subset of a codis-dashboard topom node's JSON that
+// Source implementations care about: the address its HTTP API (and thus
+// this proxy) should dial.
+type topomMeta struct {
+	AdminAddr string `json:"admin_addr"`
+}
+
+func decodeTopom(b []byte) (string, error) {
+	var t topomMeta
+	if err := json.Unmarshal(b, &t); err != nil {
+		return "", errors.Trace(err)
+	}
+	return t.AdminAddr, nil
+}
+
+// topomProductName strips prefix and the trailing "/topom" off key, leaving
+// the product (cluster) name in between, e.g. "/codis3/foo/topom" -> "foo".
+func topomProductName(prefix, key string) string {
+	rest := strings.TrimPrefix(strings.TrimPrefix(key, prefix), "/")
+	return strings.TrimSuffix(rest, "/topom")
+}
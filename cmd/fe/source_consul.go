@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/consul/api"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// ConsulSource discovers dashboards under <prefix>/<product>/topom in a
+// Consul KV store, long-polling via blocking queries.
+type ConsulSource struct {
+	addr   string
+	prefix string
+}
+
+func newConsulSource(u *url.URL) (*ConsulSource, error) {
+	if u.Host == "" {
+		return nil, errors.Trace(fmt.Errorf("consul dashboard-list requires a host, e.g. consul://host:8500/codis"))
+	}
+	return &ConsulSource{addr: u.Host, prefix: strings.TrimPrefix(u.Path, "/")}, nil
+}
+
+func (s *ConsulSource) Watch(ctx context.Context) (<-chan map[string][]string, error) {
+	client, err := api.NewClient(&api.Config{Address: s.addr})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	kv := client.KV()
+
+	ch := make(chan map[string][]string, 1)
+	go func() {
+		defer close(ch)
+		var lastIndex uint64
+		for {
+			opts := (&api.QueryOptions{WaitIndex: lastIndex}).WithContext(ctx)
+			pairs, meta, err := kv.List(s.prefix, opts)
+			if err != nil {
+				log.WarnErrorf(errors.Trace(err), "list %s from consul failed", s.prefix)
+				select {
+				case <-time.After(time.Second * 5):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+			// A LastIndex that goes backwards (e.g. a Consul server
+			// restart/restore) must reset WaitIndex to 0: reusing the
+			// stale-high value would make the next blocking query return
+			// immediately forever, hot-looping against Consul.
+			if meta.LastIndex < lastIndex {
+				lastIndex = 0
+			} else {
+				lastIndex = meta.LastIndex
+			}
+
+			m := make(map[string][]string)
+			for _, p := range pairs {
+				if !strings.HasSuffix(p.Key, "/topom") {
+					continue
+				}
+				name := topomProductName(s.prefix, p.Key)
+				if addr, err := decodeTopom(p.Value); err == nil && addr != "" {
+					m[name] = append(m[name], addr)
+				}
+			}
+
+			select {
+			case ch <- m:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// EtcdSource discovers dashboards registered by codis-dashboard under
+// <prefix>/<product>/topom in an etcd v3 cluster, e.g. /codis3/<product>.
+type EtcdSource struct {
+	endpoints []string
+	prefix    string
+}
+
+func newEtcdSource(u *url.URL) (*EtcdSource, error) {
+	if u.Host == "" {
+		return nil, errors.Trace(fmt.Errorf("etcd dashboard-list requires a host, e.g. etcd://host:2379/codis3"))
+	}
+	return &EtcdSource{endpoints: strings.Split(u.Host, ","), prefix: u.Path}, nil
+}
+
+func (s *EtcdSource) Watch(ctx context.Context) (<-chan map[string][]string, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   s.endpoints,
+		DialTimeout: time.Second * 5,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ch := make(chan map[string][]string, 1)
+	go func() {
+		defer close(ch)
+		defer cli.Close()
+
+		emit := func() {
+			m, err := s.list(ctx, cli)
+			if err != nil {
+				log.WarnErrorf(err, "list %s from etcd failed", s.prefix)
+				return
+			}
+			select {
+			case ch <- m:
+			case <-ctx.Done():
+			}
+		}
+		emit()
+
+		// etcd's Watch channel closes on a session loss (e.g. a transient
+		// coordinator hiccup), not just on ctx cancellation; re-establish it
+		// rather than returning, or a single blip would silently freeze
+		// discovery for the rest of the process's life.
+		wch := cli.Watch(ctx, s.prefix, clientv3.WithPrefix())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case _, ok := <-wch:
+				if !ok {
+					log.Warnf("etcd watch of %s closed, reconnecting", s.prefix)
+					select {
+					case <-time.After(time.Second * 5):
+					case <-ctx.Done():
+						return
+					}
+					wch = cli.Watch(ctx, s.prefix, clientv3.WithPrefix())
+					// Re-sync in case the session loss spanned a change,
+					// since the new watch only sees events from here on.
+					emit()
+					continue
+				}
+				emit()
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (s *EtcdSource) list(ctx context.Context, cli *clientv3.Client) (map[string][]string, error) {
+	resp, err := cli.Get(ctx, s.prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	m := make(map[string][]string)
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		if !strings.HasSuffix(key, "/topom") {
+			continue
+		}
+		name := topomProductName(s.prefix, key)
+		if addr, err := decodeTopom(kv.Value); err == nil && addr != "" {
+			m[name] = append(m[name], addr)
+		}
+	}
+	return m, nil
+}
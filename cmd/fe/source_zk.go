@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// ZkSource discovers dashboards under <prefix>/<product>/topom in
+// ZooKeeper, matching the coordinator codis-dashboard itself already uses.
+type ZkSource struct {
+	servers []string
+	prefix  string
+}
+
+func newZkSource(u *url.URL) (*ZkSource, error) {
+	if u.Host == "" {
+		return nil, errors.Trace(fmt.Errorf("zk dashboard-list requires at least one server, e.g. zk://zk1,zk2/codis3"))
+	}
+	return &ZkSource{servers: strings.Split(u.Host, ","), prefix: u.Path}, nil
+}
+
+func (s *ZkSource) Watch(ctx context.Context) (<-chan map[string][]string, error) {
+	conn, _, err := zk.Connect(s.servers, time.Second*10)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ch := make(chan map[string][]string, 1)
+	go func() {
+		defer close(ch)
+		defer conn.Close()
+
+		// prevDone is closed once the next iteration's watches supersede it,
+		// so a product whose topom watch never fires doesn't dangle past the
+		// round that armed it.
+		var prevDone chan struct{}
+		for {
+			if prevDone != nil {
+				close(prevDone)
+			}
+			done := make(chan struct{})
+			prevDone = done
+
+			products, _, childEvents, err := conn.ChildrenW(s.prefix)
+			if err != nil {
+				log.WarnErrorf(errors.Trace(err), "list children of %s from zk failed", s.prefix)
+				select {
+				case <-time.After(time.Second * 5):
+					continue
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			// changed fires on either a child add/remove under s.prefix or a
+			// data change on any individual product's topom znode, so a
+			// dashboard leader failover (which rewrites admin_addr in place,
+			// without touching the product list) is picked up too.
+			changed := make(chan zk.Event, 1)
+			forward := func(events <-chan zk.Event) {
+				select {
+				case e := <-events:
+					select {
+					case changed <- e:
+					default:
+					}
+				case <-done:
+				}
+			}
+			go forward(childEvents)
+
+			m := make(map[string][]string)
+			for _, name := range products {
+				b, _, topomEvents, err := conn.GetW(path.Join(s.prefix, name, "topom"))
+				if err != nil {
+					continue
+				}
+				go forward(topomEvents)
+				if addr, err := decodeTopom(b); err == nil && addr != "" {
+					m[name] = append(m[name], addr)
+				}
+			}
+
+			select {
+			case ch <- m:
+			case <-ctx.Done():
+				return
+			}
+
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
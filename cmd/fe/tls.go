@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/wandoulabs/codis/pkg/utils/errors"
+	"github.com/wandoulabs/codis/pkg/utils/log"
+)
+
+// certReloader serves a certificate loaded from a cert/key pair on disk,
+// transparently reloading it on SIGHUP or when the cert file's mtime
+// changes, so rotation doesn't require restarting codis-fe.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	go r.watch()
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	fi, err := os.Stat(r.certFile)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = fi.ModTime()
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) watch() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sighup:
+			r.tryReload("sighup")
+		case <-ticker.C:
+			fi, err := os.Stat(r.certFile)
+			if err != nil {
+				continue
+			}
+			r.mu.RLock()
+			changed := !fi.ModTime().Equal(r.modTime)
+			r.mu.RUnlock()
+			if changed {
+				r.tryReload("mtime changed")
+			}
+		}
+	}
+}
+
+func (r *certReloader) tryReload(reason string) {
+	if err := r.reload(); err != nil {
+		log.WarnErrorf(err, "reload tls cert %s failed", r.certFile)
+	} else {
+		log.Warnf("reloaded tls cert %s (%s)", r.certFile, reason)
+	}
+}
+
+// wrapTLSListener wraps l with TLS when either a static cert/key pair or an
+// ACME domain was configured; it returns l unchanged otherwise.
+func wrapTLSListener(l net.Listener, certFile, keyFile, acmeDomain, acmeCacheDir, acmeHTTPAddr string) (net.Listener, error) {
+	switch {
+	case certFile != "" && keyFile != "":
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg := &tls.Config{GetCertificate: reloader.GetCertificate}
+		return tls.NewListener(l, cfg), nil
+
+	case acmeDomain != "":
+		if acmeCacheDir == "" {
+			acmeCacheDir = "acme-cache"
+		}
+		if acmeHTTPAddr == "" {
+			acmeHTTPAddr = ":80"
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeDomain),
+			Cache:      autocert.DirCache(acmeCacheDir),
+		}
+		go func() {
+			if err := http.ListenAndServe(acmeHTTPAddr, m.HTTPHandler(nil)); err != nil {
+				log.WarnErrorf(errors.Trace(err), "acme http-01 challenge listener on %s failed", acmeHTTPAddr)
+			}
+		}()
+		return tls.NewListener(l, m.TLSConfig()), nil
+
+	default:
+		return l, nil
+	}
+}
+
+// serveRedirectHTTP stands up a plain-HTTP listener on addr that 301s every
+// request to the same host/path under https://, for deployments that also
+// want plain :80 to keep working for browsers typed without a scheme.
+func serveRedirectHTTP(addr string) {
+	go func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			target := "https://" + req.Host + req.URL.RequestURI()
+			http.Redirect(w, req, target, http.StatusMovedPermanently)
+		})
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.WarnErrorf(errors.Trace(err), "http redirect listener on %s failed", addr)
+		}
+	}()
+}